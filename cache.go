@@ -0,0 +1,119 @@
+package caddy_maxmind_geolocation
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	defaultCacheSize = 10000
+	defaultCacheTTL  = time.Hour
+)
+
+// cacheLookups counts cache hits and misses across every matcher instance,
+// labeled by db_path so multiple configured databases are distinguishable.
+// It is registered once, package-wide, against the default registerer that
+// Caddy's admin metrics endpoint already serves.
+var cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "caddy",
+	Subsystem: "maxmind_geolocation",
+	Name:      "cache_lookups_total",
+	Help:      "Count of geolocation cache lookups, labeled by result (hit or miss).",
+}, []string{"db_path", "result"})
+
+type cacheEntry struct {
+	key    string
+	value  geoResult
+	reader *maxminddb.Reader
+	expiry time.Time
+}
+
+// geoCache is a concurrency-safe, fixed-size LRU cache of geoResult keyed
+// by client IP. Entries are also tagged with the *maxminddb.Reader that
+// produced them, so a database hot-swap (see dbUpdater) invalidates every
+// entry from the old reader the first time it's looked up again, without
+// needing to walk and evict the whole cache up front.
+type geoCache struct {
+	dbPath string
+	size   int
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func newGeoCache(dbPath string, size int, ttl time.Duration) *geoCache {
+	return &geoCache{
+		dbPath:  dbPath,
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element, size),
+	}
+}
+
+// clear wholesale-invalidates the cache. It is hooked up to a dbUpdater's
+// hot-swap so a freshly downloaded database takes effect immediately
+// instead of waiting for every entry to expire or be proven stale one at a
+// time.
+func (c *geoCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	c.entries = make(map[string]*list.Element, c.size)
+}
+
+func (c *geoCache) get(key string, reader *maxminddb.Reader) (geoResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		cacheLookups.WithLabelValues(c.dbPath, "miss").Inc()
+		return geoResult{}, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if entry.reader != reader || time.Now().After(entry.expiry) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		cacheLookups.WithLabelValues(c.dbPath, "miss").Inc()
+		return geoResult{}, false
+	}
+
+	c.order.MoveToFront(el)
+	cacheLookups.WithLabelValues(c.dbPath, "hit").Inc()
+	return entry.value, true
+}
+
+func (c *geoCache) set(key string, reader *maxminddb.Reader, value geoResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*cacheEntry)
+		entry.value = value
+		entry.reader = reader
+		entry.expiry = time.Now().Add(c.ttl)
+		c.order.MoveToFront(el)
+		return
+	}
+
+	entry := &cacheEntry{key: key, value: value, reader: reader, expiry: time.Now().Add(c.ttl)}
+	el := c.order.PushFront(entry)
+	c.entries[key] = el
+
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		if oldest == nil {
+			break
+		}
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
@@ -0,0 +1,84 @@
+package caddy_maxmind_geolocation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+func TestGeoCacheHitAndMiss(t *testing.T) {
+	c := newGeoCache("test.mmdb", 2, time.Hour)
+	var reader *maxminddb.Reader
+
+	if _, ok := c.get("1.2.3.4", reader); ok {
+		t.Fatal("expected a miss on an empty cache")
+	}
+
+	c.set("1.2.3.4", reader, geoResult{country: "US", allowed: true})
+
+	got, ok := c.get("1.2.3.4", reader)
+	if !ok {
+		t.Fatal("expected a hit after set")
+	}
+	if got.country != "US" || !got.allowed {
+		t.Fatalf("unexpected cached value: %+v", got)
+	}
+}
+
+func TestGeoCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newGeoCache("test.mmdb", 2, time.Hour)
+	var reader *maxminddb.Reader
+
+	c.set("1.1.1.1", reader, geoResult{country: "A"})
+	c.set("2.2.2.2", reader, geoResult{country: "B"})
+	// Touch 1.1.1.1 so 2.2.2.2 becomes the least recently used entry.
+	c.get("1.1.1.1", reader)
+	c.set("3.3.3.3", reader, geoResult{country: "C"})
+
+	if _, ok := c.get("2.2.2.2", reader); ok {
+		t.Fatal("expected 2.2.2.2 to have been evicted")
+	}
+	if _, ok := c.get("1.1.1.1", reader); !ok {
+		t.Fatal("expected 1.1.1.1 to still be cached")
+	}
+	if _, ok := c.get("3.3.3.3", reader); !ok {
+		t.Fatal("expected 3.3.3.3 to still be cached")
+	}
+}
+
+func TestGeoCacheExpiresTTL(t *testing.T) {
+	c := newGeoCache("test.mmdb", 2, time.Millisecond)
+	var reader *maxminddb.Reader
+
+	c.set("1.2.3.4", reader, geoResult{country: "US"})
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok := c.get("1.2.3.4", reader); ok {
+		t.Fatal("expected entry to have expired")
+	}
+}
+
+func TestGeoCacheInvalidatedByReaderSwap(t *testing.T) {
+	c := newGeoCache("test.mmdb", 2, time.Hour)
+	var oldReader, newReader *maxminddb.Reader
+	newReader = &maxminddb.Reader{}
+
+	c.set("1.2.3.4", oldReader, geoResult{country: "US"})
+
+	if _, ok := c.get("1.2.3.4", newReader); ok {
+		t.Fatal("expected entry from a stale reader to be treated as a miss")
+	}
+}
+
+func TestGeoCacheClear(t *testing.T) {
+	c := newGeoCache("test.mmdb", 2, time.Hour)
+	var reader *maxminddb.Reader
+
+	c.set("1.2.3.4", reader, geoResult{country: "US"})
+	c.clear()
+
+	if _, ok := c.get("1.2.3.4", reader); ok {
+		t.Fatal("expected cache to be empty after clear")
+	}
+}
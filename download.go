@@ -0,0 +1,243 @@
+package caddy_maxmind_geolocation
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// dbUpdaterPool lets every matcher configured with the same database
+// download settings share a single downloader and background refresh
+// goroutine instead of each opening and polling its own copy.
+var dbUpdaterPool = caddy.NewUsagePool()
+
+// dbUpdaterKey identifies a unique combination of download settings; two
+// matchers with the same key share a dbUpdater.
+type dbUpdaterKey struct {
+	path       string
+	editionID  string
+	accountID  string
+	licenseKey string
+}
+
+// dbUpdater owns a single MaxMind database file, optionally downloading it
+// on first use and periodically re-downloading it on a schedule. reader
+// always points at a valid, already-opened database; it is swapped, never
+// mutated in place, so in-flight lookups keep using the handle they loaded.
+type dbUpdater struct {
+	path       string
+	editionID  string
+	accountID  string
+	licenseKey string
+	interval   time.Duration
+
+	reader atomic.Pointer[maxminddb.Reader]
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	swapMu      sync.Mutex
+	onReaderNew []func()
+}
+
+// onSwap registers fn to run whenever the background refresh hot-swaps in a
+// newly downloaded reader, e.g. to invalidate a cache keyed off the old one.
+func (u *dbUpdater) onSwap(fn func()) {
+	u.swapMu.Lock()
+	defer u.swapMu.Unlock()
+	u.onReaderNew = append(u.onReaderNew, fn)
+}
+
+// newDBUpdater downloads path if needed, opens it, and if both licenseKey
+// and interval are set starts a background goroutine that re-downloads and
+// hot-swaps it on that schedule.
+func newDBUpdater(path, editionID, accountID, licenseKey string, interval time.Duration) (*dbUpdater, error) {
+	u := &dbUpdater{
+		path:       path,
+		editionID:  editionID,
+		accountID:  accountID,
+		licenseKey: licenseKey,
+		interval:   interval,
+	}
+
+	if u.needsDownload() {
+		if err := u.download(); err != nil {
+			return nil, err
+		}
+	}
+
+	reader, err := maxminddb.Open(u.path)
+	if err != nil {
+		return nil, err
+	}
+	u.reader.Store(reader)
+
+	if u.licenseKey != "" && u.interval > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		u.cancel = cancel
+		u.done = make(chan struct{})
+		go u.refreshLoop(ctx)
+	}
+
+	return u, nil
+}
+
+// needsDownload reports whether path is missing, or is old enough to
+// warrant a re-download. It never forces a download when no license key is
+// configured, since there would be nothing to fetch.
+func (u *dbUpdater) needsDownload() bool {
+	if u.licenseKey == "" {
+		return false
+	}
+	info, err := os.Stat(u.path)
+	if err != nil {
+		return true
+	}
+	if u.interval <= 0 {
+		return false
+	}
+	return time.Since(info.ModTime()) >= u.interval
+}
+
+func (u *dbUpdater) refreshLoop(ctx context.Context) {
+	defer close(u.done)
+	ticker := time.NewTicker(u.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := u.download(); err != nil {
+				continue
+			}
+			reader, err := maxminddb.Open(u.path)
+			if err != nil {
+				continue
+			}
+			if old := u.reader.Swap(reader); old != nil {
+				old.Close()
+			}
+			u.swapMu.Lock()
+			callbacks := u.onReaderNew
+			u.swapMu.Unlock()
+			for _, cb := range callbacks {
+				cb()
+			}
+		}
+	}
+}
+
+// download fetches the latest tar.gz for editionID, verifies its sha256
+// checksum, and atomically replaces path with the .mmdb file it contains.
+func (u *dbUpdater) download() error {
+	archiveURL := fmt.Sprintf(
+		"https://download.maxmind.com/app/geoip_download?edition_id=%s&license_key=%s&suffix=tar.gz",
+		u.editionID, u.licenseKey,
+	)
+
+	archive, err := u.fetch(archiveURL)
+	if err != nil {
+		return fmt.Errorf("downloading %s: %v", u.editionID, err)
+	}
+
+	sum, err := u.fetch(archiveURL + ".sha256")
+	if err != nil {
+		return fmt.Errorf("downloading checksum for %s: %v", u.editionID, err)
+	}
+	wantSum := strings.Fields(string(sum))
+	if len(wantSum) == 0 {
+		return fmt.Errorf("empty checksum response for %s", u.editionID)
+	}
+	gotSum := sha256.Sum256(archive)
+	if hex.EncodeToString(gotSum[:]) != wantSum[0] {
+		return fmt.Errorf("checksum mismatch for %s", u.editionID)
+	}
+
+	return u.extract(archive)
+}
+
+func (u *dbUpdater) fetch(url string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if u.accountID != "" {
+		req.SetBasicAuth(u.accountID, u.licenseKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// extract finds the .mmdb file inside the tar.gz archive and writes it to
+// u.path, replacing the existing file atomically via rename.
+func (u *dbUpdater) extract(archive []byte) error {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("no .mmdb file found in archive for %s", u.editionID)
+		}
+		if err != nil {
+			return err
+		}
+		if !strings.HasSuffix(hdr.Name, ".mmdb") {
+			continue
+		}
+
+		tmp, err := os.CreateTemp(filepath.Dir(u.path), ".maxmind-*.mmdb.tmp")
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(tmp, tr); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+		if err := tmp.Close(); err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+		return os.Rename(tmp.Name(), u.path)
+	}
+}
+
+// Destruct implements caddy.Destructor, stopping the refresh goroutine and
+// closing the database handle when the last matcher using it is cleaned up.
+func (u *dbUpdater) Destruct() error {
+	if u.cancel != nil {
+		u.cancel()
+		<-u.done
+	}
+	if reader := u.reader.Load(); reader != nil {
+		return reader.Close()
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package caddy_maxmind_geolocation
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func buildTarGz(t *testing.T, name string, content []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	if err := tw.WriteHeader(&tar.Header{Name: name, Size: int64(len(content)), Mode: 0644}); err != nil {
+		t.Fatalf("writing tar header: %v", err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatalf("writing tar content: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("closing tar writer: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("closing gzip writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestDbUpdaterExtract(t *testing.T) {
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "GeoLite2-City.mmdb")
+	archive := buildTarGz(t, "GeoLite2-City_20260101/GeoLite2-City.mmdb", []byte("fake-mmdb-contents"))
+
+	u := &dbUpdater{path: dest, editionID: "GeoLite2-City"}
+	if err := u.extract(archive); err != nil {
+		t.Fatalf("extract failed: %v", err)
+	}
+
+	got, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatalf("reading extracted file: %v", err)
+	}
+	if string(got) != "fake-mmdb-contents" {
+		t.Fatalf("unexpected extracted content: %q", got)
+	}
+}
+
+func TestDbUpdaterExtractNoMmdb(t *testing.T) {
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "GeoLite2-City.mmdb")
+	archive := buildTarGz(t, "GeoLite2-City_20260101/LICENSE.txt", []byte("not a database"))
+
+	u := &dbUpdater{path: dest, editionID: "GeoLite2-City"}
+	if err := u.extract(archive); err == nil {
+		t.Fatal("expected an error when the archive has no .mmdb file")
+	}
+}
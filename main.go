@@ -8,15 +8,80 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
-	"github.com/ip2location/ip2location-go"
+	"github.com/oschwald/maxminddb-golang"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
+// defaultClientIPHeaders is used when ClientIPHeaders is not set, in the
+// order they should be checked.
+var defaultClientIPHeaders = []string{"X-Forwarded-For", "X-Real-IP"}
+
+// privateCIDRs are the ranges considered private/loopback when deciding how
+// to treat a client IP that cannot be meaningfully looked up in a GeoIP
+// database. Unlike net.IP.IsPrivate(), the list also covers the loopback
+// and IPv6 link-local ranges.
+var privateCIDRs = []string{
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"127.0.0.0/8",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+func isPrivateIP(ip net.IP) bool {
+	for _, cidr := range privateCIDRs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err == nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIPOrCIDR parses s as either a bare IP address or a CIDR range,
+// returning a /32 (or /128) network for a bare address.
+func parseIPOrCIDR(s string) (*net.IPNet, error) {
+	if _, ipNet, err := net.ParseCIDR(s); err == nil {
+		return ipNet, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not a valid IP address or CIDR range", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// parseForwardedIP parses a single entry of a client IP header, stripping
+// an optional port and the brackets around a bracketed IPv6 address.
+func parseForwardedIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil
+	}
+	if strings.HasPrefix(s, "[") {
+		if end := strings.Index(s, "]"); end != -1 {
+			s = s[1:end]
+		}
+	} else if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(s)
+}
+
 // Interface guards
 var (
 	_ caddy.Module             = (*MaxmindGeolocation)(nil)
@@ -27,15 +92,63 @@ var (
 )
 
 func init() {
-	caddy.RegisterModule(MaxmindGeolocation{})
+	caddy.RegisterModule(&MaxmindGeolocation{})
+}
+
+// geoRecord mirrors the subset of the GeoIP2-Country / GeoIP2-City schema
+// that this module cares about. It is safe to decode a Country database
+// into it too, the City-only fields will simply stay at their zero value.
+type geoRecord struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	// RepresentedCountry is set instead of, or in addition to, Country for
+	// things like US military bases, embassies and some satellite
+	// providers: Country is the country the traffic is physically routed
+	// through, RepresentedCountry is the country it's considered to be
+	// part of.
+	RepresentedCountry struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"represented_country"`
+	Subdivisions []struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"subdivisions"`
+	City struct {
+		GeoNameID uint `maxminddb:"geoname_id"`
+	} `maxminddb:"city"`
+}
+
+// Values accepted by RepresentedCountryMode.
+const (
+	// RepresentedCountryIgnore only ever looks at Country. This is the
+	// default, and matches the behavior before represented_country_mode
+	// was introduced.
+	RepresentedCountryIgnore = "ignore"
+	// RepresentedCountryRequireMatch denies the request unless both
+	// Country and, when present, RepresentedCountry pass the allow/deny
+	// country lists.
+	RepresentedCountryRequireMatch = "require_match"
+	// RepresentedCountryUseRepresented checks RepresentedCountry when
+	// present, falling back to Country otherwise.
+	RepresentedCountryUseRepresented = "use_represented"
+)
+
+// asnRecord mirrors the subset of the GeoIP2-ASN schema that this module
+// cares about.
+type asnRecord struct {
+	AutonomousSystemNumber uint `maxminddb:"autonomous_system_number"`
 }
 
-// Allows to filter requests based on source IP country.
+// Allows to filter requests based on source IP country, subdivision, city or ASN.
 type MaxmindGeolocation struct {
 
-	// The path of the ip2location db file.
+	// The path of the GeoIP2 Country or City database file.
 	DbPath string `json:"db_path"`
 
+	// The path of the GeoIP2 ASN database file. Only required if AllowASNs
+	// or DenyASNs is specified.
+	AsnDbPath string `json:"asn_db_path"`
+
 	// The path of the zap log
 	LogPath string `json:"log_path"`
 
@@ -53,22 +166,179 @@ type MaxmindGeolocation struct {
 	// You can specify the special value "UNK" to match unrecognized countries.
 	DenyCountries []string `json:"deny_countries"`
 
-	dbInst *ip2location.DB
-	logger *zap.Logger
+	// How to treat MaxMind's represented_country record (used for things
+	// like US military bases and embassies abroad) relative to the
+	// registered country. One of "ignore" (the default), "require_match"
+	// or "use_represented"; see the RepresentedCountry* constants.
+	RepresentedCountryMode string `json:"represented_country_mode,omitempty"`
+
+	// A list of subdivisions that the filter will allow, in ISO 3166-2 form
+	// (e.g. "US-CA"). Requires DbPath to point to a City database.
+	// If you specify this, you should not specify DenySubdivisions.
+	// If both are specified, DenySubdivisions will take precedence.
+	AllowSubdivisions []string `json:"allow_subdivisions"`
+
+	// A list of subdivisions that the filter will deny, in ISO 3166-2 form
+	// (e.g. "US-CA"). Requires DbPath to point to a City database.
+	// If you specify this, you should not specify AllowSubdivisions.
+	// If both are specified, DenySubdivisions will take precedence.
+	DenySubdivisions []string `json:"deny_subdivisions"`
+
+	// A list of GeoName IDs of the cities that the filter will allow.
+	// GeoName IDs are used instead of city names to avoid locale ambiguity.
+	// Requires DbPath to point to a City database.
+	// If you specify this, you should not specify DenyCities.
+	// If both are specified, DenyCities will take precedence.
+	AllowCities []string `json:"allow_cities"`
+
+	// A list of GeoName IDs of the cities that the filter will deny.
+	// Requires DbPath to point to a City database.
+	// If you specify this, you should not specify AllowCities.
+	// If both are specified, DenyCities will take precedence.
+	DenyCities []string `json:"deny_cities"`
+
+	// A list of autonomous system numbers that the filter will allow.
+	// Requires AsnDbPath.
+	// If you specify this, you should not specify DenyASNs.
+	// If both are specified, DenyASNs will take precedence.
+	AllowASNs []string `json:"allow_asns"`
+
+	// A list of autonomous system numbers that the filter will deny.
+	// Requires AsnDbPath.
+	// If you specify this, you should not specify AllowASNs.
+	// If both are specified, DenyASNs will take precedence.
+	DenyASNs []string `json:"deny_asns"`
+
+	// A list of CIDR ranges (or single IPs) of reverse proxies that are
+	// trusted to set client IP headers. When r.RemoteAddr falls inside one
+	// of these ranges, the client IP is taken from ClientIPHeaders instead.
+	TrustedProxies []string `json:"trusted_proxies"`
+
+	// The headers to look at, in order, to find the client IP once the
+	// direct peer is a trusted proxy. Defaults to "X-Forwarded-For" and
+	// "X-Real-IP". X-Forwarded-For is walked right to left, skipping
+	// further trusted hops, stopping at the first untrusted address.
+	ClientIPHeaders []string `json:"client_ip_headers"`
+
+	// If true, a client IP that resolves to a private or loopback address
+	// is allowed without checking any country, subdivision, city or ASN
+	// list; DenyIPs is still evaluated before it. If false (the
+	// default), such an address is treated as "UNK" instead of being
+	// looked up in the database.
+	AllowPrivate bool `json:"allow_private"`
+
+	// If true, the detected country, subdivision, city and ASN are written
+	// to the X-IPCountry, X-IPSubdivision, X-IPCity and X-IPASN request
+	// headers before Match returns, so downstream handlers and the proxied
+	// backend can reuse the lookup instead of repeating it. This mutates
+	// r.Header as a side effect of Match, which is not strictly compatible
+	// with caddyhttp.RequestMatcher (matchers are expected to be read-only),
+	// but is the simplest way to share the result with the rest of the
+	// request pipeline.
+	AddHeaders bool `json:"add_headers"`
+
+	// The MaxMind license key used to download DbPath automatically. If
+	// empty, DbPath is expected to already exist on disk and is never
+	// downloaded or refreshed.
+	LicenseKey string `json:"license_key"`
+
+	// The MaxMind account ID used to download DbPath automatically, sent
+	// as the basic auth username alongside LicenseKey.
+	AccountID string `json:"account_id"`
+
+	// The edition to download, e.g. "GeoLite2-Country", "GeoLite2-City" or
+	// "GeoLite2-ASN". Required when LicenseKey is set.
+	EditionID string `json:"edition_id"`
+
+	// How often to check DbPath's age and re-download it if it is older
+	// than this. Zero (the default) disables the periodic refresh; DbPath
+	// is still downloaded once on provision if it is missing.
+	UpdateInterval caddy.Duration `json:"update_interval,omitempty"`
+
+	// A list of single IPs or CIDR ranges that are always allowed, without
+	// even looking them up in the database. Evaluated before AllowCountries
+	// / DenyCountries and the other dimensions.
+	AllowIPs []string `json:"allow_ips"`
+
+	// A list of single IPs or CIDR ranges that are always denied, without
+	// even looking them up in the database. Evaluated before AllowIPs.
+	DenyIPs []string `json:"deny_ips"`
+
+	// The maximum number of client IPs to keep cached lookup results for.
+	// Defaults to 10000 when nil; set to 0 to disable the cache entirely.
+	CacheSize *int `json:"cache_size,omitempty"`
+
+	// How long a cached lookup result stays valid. Defaults to 1 hour.
+	// Keeping this bounded means a database hot-swap from update_interval
+	// eventually takes effect even though the cache isn't proactively
+	// invalidated entry by entry.
+	CacheTTL caddy.Duration `json:"cache_ttl,omitempty"`
+
+	dbInst           atomic.Pointer[maxminddb.Reader]
+	asnDbInst        *maxminddb.Reader
+	logger           *zap.Logger
+	trustedProxyNets []*net.IPNet
+	allowIPNets      []*net.IPNet
+	denyIPNets       []*net.IPNet
+	cache            *geoCache
+
+	updater    *dbUpdater
+	updaterKey dbUpdaterKey
 }
 
 /*
 	The matcher configuration will have a single block with the following parameters:
 
-	- `db_path`: required, is the path to the GeoLite2-Country.mmdb file
+	- `db_path`: required, is the path to the GeoLite2-Country.mmdb or GeoLite2-City.mmdb file
+
+	- `asn_db_path`: the path to the GeoLite2-ASN.mmdb file, required only if you use `allow_asns` / `deny_asns`
 
 	- `allow_countries`: a space-separated list of allowed countries
 
 	- `deny_countries`: a space-separated list of denied countries.
 
-	You will want specify just one of `allow_countries` or `deny_countries`. If you
-	specify both of them, denied countries will take precedence over allowed ones.
-	If you specify none of them, all requests will be denied.
+	- `represented_country_mode`: how to treat MaxMind's represented_country relative to the registered country: `ignore` (default), `require_match`, or `use_represented`
+
+	- `allow_subdivisions`: a space-separated list of allowed subdivisions, in ISO 3166-2 form (e.g. `US-CA`). Requires a City database.
+
+	- `deny_subdivisions`: a space-separated list of denied subdivisions, in ISO 3166-2 form. Requires a City database.
+
+	- `allow_cities`: a space-separated list of allowed GeoName IDs. Requires a City database.
+
+	- `deny_cities`: a space-separated list of denied GeoName IDs. Requires a City database.
+
+	- `allow_asns`: a space-separated list of allowed autonomous system numbers. Requires `asn_db_path`.
+
+	- `deny_asns`: a space-separated list of denied autonomous system numbers. Requires `asn_db_path`.
+
+	- `trusted_proxies`: a space-separated list of CIDR ranges (or single IPs) of reverse proxies that are trusted to set client IP headers
+
+	- `client_ip_headers`: a space-separated list of headers to read the client IP from, in order, once the direct peer matched `trusted_proxies`. Defaults to `X-Forwarded-For` and `X-Real-IP`
+
+	- `allow_private`: if present, a client IP resolving to a private or loopback address is allowed unless it is listed in `deny_ips`
+
+	- `add_headers`: if present, the detected country, subdivision, city and ASN are written to the X-IPCountry, X-IPSubdivision, X-IPCity and X-IPASN request headers
+
+	- `license_key`: a MaxMind license key, used to download `db_path` automatically if it is missing or stale. Requires `edition_id`
+
+	- `account_id`: a MaxMind account ID, sent alongside `license_key` when downloading `db_path`
+
+	- `edition_id`: the database edition to download, e.g. `GeoLite2-Country`, `GeoLite2-City` or `GeoLite2-ASN`
+
+	- `update_interval`: how often to check whether `db_path` should be re-downloaded, e.g. `24h`. Defaults to never
+
+	- `allow_ips`: a space-separated list of single IPs or CIDR ranges that are always allowed, without a database lookup
+
+	- `deny_ips`: a space-separated list of single IPs or CIDR ranges that are always denied, without a database lookup. Takes precedence over `allow_ips`
+
+	- `cache_size`: the maximum number of client IPs to cache lookup results for. Defaults to 10000; `0` disables the cache
+
+	- `cache_ttl`: how long a cached lookup result stays valid, e.g. `1h`. Defaults to 1 hour
+
+	For each of the pairs above, you will want specify just one of the allow/deny lists. If you
+	specify both of them, the deny list will take precedence over the allow one. If you specify
+	none of them, that dimension is not checked. The request is allowed only if every configured
+	dimension allows it.
 
 	Examples are available at https://github.com/JamesShiu/caddy-maxmind-geolocation/
 */
@@ -85,6 +355,48 @@ func (m *MaxmindGeolocation) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				current = 3
 			case "log_path":
 				current = 4
+			case "asn_db_path":
+				current = 5
+			case "allow_subdivisions":
+				current = 6
+			case "deny_subdivisions":
+				current = 7
+			case "allow_cities":
+				current = 8
+			case "deny_cities":
+				current = 9
+			case "allow_asns":
+				current = 10
+			case "deny_asns":
+				current = 11
+			case "trusted_proxies":
+				current = 12
+			case "client_ip_headers":
+				current = 13
+			case "allow_private":
+				m.AllowPrivate = true
+				current = 0
+			case "add_headers":
+				m.AddHeaders = true
+				current = 0
+			case "license_key":
+				current = 14
+			case "account_id":
+				current = 15
+			case "edition_id":
+				current = 16
+			case "update_interval":
+				current = 17
+			case "allow_ips":
+				current = 18
+			case "deny_ips":
+				current = 19
+			case "cache_size":
+				current = 20
+			case "cache_ttl":
+				current = 21
+			case "represented_country_mode":
+				current = 22
 			default:
 				switch current {
 				case 1:
@@ -97,6 +409,62 @@ func (m *MaxmindGeolocation) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				case 4:
 					m.LogPath = d.Val()
 					current = 0
+				case 5:
+					m.AsnDbPath = d.Val()
+					current = 0
+				case 6:
+					m.AllowSubdivisions = append(m.AllowSubdivisions, d.Val())
+				case 7:
+					m.DenySubdivisions = append(m.DenySubdivisions, d.Val())
+				case 8:
+					m.AllowCities = append(m.AllowCities, d.Val())
+				case 9:
+					m.DenyCities = append(m.DenyCities, d.Val())
+				case 10:
+					m.AllowASNs = append(m.AllowASNs, d.Val())
+				case 11:
+					m.DenyASNs = append(m.DenyASNs, d.Val())
+				case 12:
+					m.TrustedProxies = append(m.TrustedProxies, d.Val())
+				case 13:
+					m.ClientIPHeaders = append(m.ClientIPHeaders, d.Val())
+				case 14:
+					m.LicenseKey = d.Val()
+					current = 0
+				case 15:
+					m.AccountID = d.Val()
+					current = 0
+				case 16:
+					m.EditionID = d.Val()
+					current = 0
+				case 17:
+					interval, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return fmt.Errorf("invalid update_interval %q: %v", d.Val(), err)
+					}
+					m.UpdateInterval = caddy.Duration(interval)
+					current = 0
+				case 18:
+					m.AllowIPs = append(m.AllowIPs, d.Val())
+				case 19:
+					m.DenyIPs = append(m.DenyIPs, d.Val())
+				case 20:
+					size, err := strconv.Atoi(d.Val())
+					if err != nil {
+						return fmt.Errorf("invalid cache_size %q: %v", d.Val(), err)
+					}
+					m.CacheSize = &size
+					current = 0
+				case 21:
+					ttl, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return fmt.Errorf("invalid cache_ttl %q: %v", d.Val(), err)
+					}
+					m.CacheTTL = caddy.Duration(ttl)
+					current = 0
+				case 22:
+					m.RepresentedCountryMode = d.Val()
+					current = 0
 				default:
 					return fmt.Errorf("unexpected config parameter %s", d.Val())
 				}
@@ -106,7 +474,7 @@ func (m *MaxmindGeolocation) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	return nil
 }
 
-func (MaxmindGeolocation) CaddyModule() caddy.ModuleInfo {
+func (*MaxmindGeolocation) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
 		ID:  "http.matchers.maxmind_geolocation",
 		New: func() caddy.Module { return new(MaxmindGeolocation) },
@@ -115,22 +483,167 @@ func (MaxmindGeolocation) CaddyModule() caddy.ModuleInfo {
 
 func (m *MaxmindGeolocation) Provision(ctx caddy.Context) error {
 	var err error
+	switch m.RepresentedCountryMode {
+	case "", RepresentedCountryIgnore, RepresentedCountryRequireMatch, RepresentedCountryUseRepresented:
+	default:
+		return fmt.Errorf("invalid represented_country_mode %q", m.RepresentedCountryMode)
+	}
 	if m.LogPath != "" {
 		m.logger, err = NewLogger(m.LogPath)
 		if err != nil {
 			return fmt.Errorf("cannot open log file %s: %v", m.LogPath, err)
 		}
 	}
-	m.dbInst, err = ip2location.OpenDB(m.DbPath)
-	if err != nil {
-		return fmt.Errorf("cannot open database file %s: %v", m.DbPath, err)
+	if m.EditionID == "" && m.LicenseKey != "" {
+		return fmt.Errorf("edition_id must be set when license_key is used")
+	}
+	if m.LicenseKey != "" || m.UpdateInterval > 0 {
+		m.updaterKey = dbUpdaterKey{m.DbPath, m.EditionID, m.AccountID, m.LicenseKey}
+		val, _, err := dbUpdaterPool.LoadOrNew(m.updaterKey, func() (caddy.Destructor, error) {
+			return newDBUpdater(m.DbPath, m.EditionID, m.AccountID, m.LicenseKey, time.Duration(m.UpdateInterval))
+		})
+		if err != nil {
+			return fmt.Errorf("cannot provision database updater for %s: %v", m.DbPath, err)
+		}
+		m.updater = val.(*dbUpdater)
+		m.dbInst.Store(m.updater.reader.Load())
+	} else {
+		reader, err := maxminddb.Open(m.DbPath)
+		if err != nil {
+			return fmt.Errorf("cannot open database file %s: %v", m.DbPath, err)
+		}
+		m.dbInst.Store(reader)
+	}
+	if m.AsnDbPath == "" && (len(m.AllowASNs) > 0 || len(m.DenyASNs) > 0) {
+		return fmt.Errorf("asn_db_path must be set when allow_asns or deny_asns is used")
+	}
+	if m.AsnDbPath != "" {
+		m.asnDbInst, err = maxminddb.Open(m.AsnDbPath)
+		if err != nil {
+			return fmt.Errorf("cannot open database file %s: %v", m.AsnDbPath, err)
+		}
+	}
+	for _, cidr := range m.TrustedProxies {
+		ipNet, err := parseIPOrCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid trusted_proxies entry: %v", err)
+		}
+		m.trustedProxyNets = append(m.trustedProxyNets, ipNet)
+	}
+	if len(m.ClientIPHeaders) == 0 {
+		m.ClientIPHeaders = defaultClientIPHeaders
+	}
+	for _, cidr := range m.AllowIPs {
+		ipNet, err := parseIPOrCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid allow_ips entry: %v", err)
+		}
+		m.allowIPNets = append(m.allowIPNets, ipNet)
+	}
+	for _, cidr := range m.DenyIPs {
+		ipNet, err := parseIPOrCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid deny_ips entry: %v", err)
+		}
+		m.denyIPNets = append(m.denyIPNets, ipNet)
+	}
+
+	cacheSize := defaultCacheSize
+	if m.CacheSize != nil {
+		cacheSize = *m.CacheSize
+	}
+	if m.CacheTTL == 0 {
+		m.CacheTTL = caddy.Duration(defaultCacheTTL)
+	}
+	if cacheSize > 0 {
+		m.cache = newGeoCache(m.DbPath, cacheSize, time.Duration(m.CacheTTL))
+		if m.updater != nil {
+			m.updater.onSwap(m.cache.clear)
+		}
 	}
 	return nil
 }
 
+func matchesIPNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// db returns the currently active reader for DbPath, following the latest
+// value hot-swapped in by the background updater when one is in use.
+func (m *MaxmindGeolocation) db() *maxminddb.Reader {
+	if m.updater != nil {
+		return m.updater.reader.Load()
+	}
+	return m.dbInst.Load()
+}
+
+func (m *MaxmindGeolocation) isTrustedProxy(ip net.IP) bool {
+	return matchesIPNets(ip, m.trustedProxyNets)
+}
+
+// clientIP returns the IP address that should be used for the geolocation
+// lookup: r.RemoteAddr, unless it is a trusted proxy, in which case the
+// client IP headers are consulted instead.
+func (m *MaxmindGeolocation) clientIP(r *http.Request) (net.IP, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	remoteIP := net.ParseIP(host)
+	if remoteIP == nil {
+		return nil, fmt.Errorf("cannot parse IP address %q", r.RemoteAddr)
+	}
+
+	if len(m.trustedProxyNets) == 0 || !m.isTrustedProxy(remoteIP) {
+		return remoteIP, nil
+	}
+
+	for _, header := range m.ClientIPHeaders {
+		if strings.EqualFold(header, "X-Forwarded-For") {
+			values := r.Header.Values(header)
+			for i := len(values) - 1; i >= 0; i-- {
+				hops := strings.Split(values[i], ",")
+				for j := len(hops) - 1; j >= 0; j-- {
+					hop := parseForwardedIP(hops[j])
+					if hop == nil {
+						continue
+					}
+					if m.isTrustedProxy(hop) {
+						continue
+					}
+					return hop, nil
+				}
+			}
+			continue
+		}
+		if value := r.Header.Get(header); value != "" {
+			if ip := parseForwardedIP(value); ip != nil {
+				return ip, nil
+			}
+		}
+	}
+
+	return remoteIP, nil
+}
+
 func (m *MaxmindGeolocation) Cleanup() error {
-	if m.dbInst != nil {
-		m.dbInst.Close()
+	if m.updater != nil {
+		_, err := dbUpdaterPool.Delete(m.updaterKey)
+		if err != nil {
+			return err
+		}
+	} else if reader := m.dbInst.Load(); reader != nil {
+		if err := reader.Close(); err != nil {
+			return err
+		}
+	}
+	if m.asnDbInst != nil {
+		m.asnDbInst.Close()
 	}
 	return nil
 }
@@ -168,51 +681,204 @@ func (m *MaxmindGeolocation) checkAllowed(item string, allowedList []string, den
 	return true
 }
 
+// countryAllowed applies AllowCountries/DenyCountries to record according
+// to RepresentedCountryMode.
+func (m *MaxmindGeolocation) countryAllowed(record geoRecord) bool {
+	switch m.RepresentedCountryMode {
+	case RepresentedCountryUseRepresented:
+		country := record.Country.IsoCode
+		if record.RepresentedCountry.IsoCode != "" {
+			country = record.RepresentedCountry.IsoCode
+		}
+		return m.checkAllowed(country, m.AllowCountries, m.DenyCountries)
+	case RepresentedCountryRequireMatch:
+		if !m.checkAllowed(record.Country.IsoCode, m.AllowCountries, m.DenyCountries) {
+			return false
+		}
+		if record.RepresentedCountry.IsoCode == "" {
+			return true
+		}
+		return m.checkAllowed(record.RepresentedCountry.IsoCode, m.AllowCountries, m.DenyCountries)
+	default:
+		return m.checkAllowed(record.Country.IsoCode, m.AllowCountries, m.DenyCountries)
+	}
+}
+
+// hasDimensions reports whether at least one allow/deny list is configured.
+func (m *MaxmindGeolocation) hasDimensions() bool {
+	return len(m.AllowCountries) > 0 || len(m.DenyCountries) > 0 ||
+		len(m.AllowSubdivisions) > 0 || len(m.DenySubdivisions) > 0 ||
+		len(m.AllowCities) > 0 || len(m.DenyCities) > 0 ||
+		len(m.AllowASNs) > 0 || len(m.DenyASNs) > 0
+}
+
+func setGeoHeaders(r *http.Request, country, subdivision, city, asn string) {
+	r.Header.Set("X-IPCountry", country)
+	r.Header.Set("X-IPSubdivision", subdivision)
+	r.Header.Set("X-IPCity", city)
+	r.Header.Set("X-IPASN", asn)
+}
+
 func (m *MaxmindGeolocation) Match(r *http.Request) bool {
 
-	// If both the allow and deny fields are empty, let the request pass
-	if len(m.AllowCountries) < 1 && len(m.DenyCountries) < 1 {
+	// If no dimension is configured, there are no IP allow/deny lists, and
+	// there is nothing to add to the request headers, let the request pass
+	// without touching the database.
+	if !m.hasDimensions() && !m.AddHeaders && len(m.allowIPNets) == 0 && len(m.denyIPNets) == 0 {
 		return true
 	}
 
-	remoteIp, _, err := net.SplitHostPort(r.RemoteAddr)
+	addr, err := m.clientIP(r)
 	if err != nil {
 		if m.logger != nil {
-			m.logger.Warn("cannot split IP address", zap.String("address", r.RemoteAddr), zap.Error(err))
+			m.logger.Warn("cannot determine client IP", zap.String("address", r.RemoteAddr), zap.Error(err))
 		}
+		return false
 	}
 
-	// Get the record from the database
-	addr := net.ParseIP(remoteIp)
-	if addr == nil {
+	// allow_ips / deny_ips short-circuit the database lookup entirely.
+	if matchesIPNets(addr, m.denyIPNets) {
 		if m.logger != nil {
-			m.logger.Warn("cannot parse IP address", zap.String("address", r.RemoteAddr))
+			m.logger.Debug("IP denied by deny_ips", zap.String("ip", addr.String()))
 		}
 		return false
 	}
-	var record ip2location.IP2Locationrecord
-	record, err = m.dbInst.Get_country_short(addr.String())
+	if matchesIPNets(addr, m.allowIPNets) {
+		if m.logger != nil {
+			m.logger.Debug("IP allowed by allow_ips", zap.String("ip", addr.String()))
+		}
+		return true
+	}
+
+	if !m.hasDimensions() && !m.AddHeaders {
+		return true
+	}
+
+	if isPrivateIP(addr) {
+		if m.AddHeaders {
+			setGeoHeaders(r, "UNK", "UNK", "UNK", "UNK")
+		}
+		if m.AllowPrivate {
+			return true
+		}
+		return m.checkAllowed("UNK", m.AllowCountries, m.DenyCountries) &&
+			m.checkAllowed("UNK", m.AllowSubdivisions, m.DenySubdivisions) &&
+			m.checkAllowed("UNK", m.AllowCities, m.DenyCities) &&
+			m.checkAllowed("UNK", m.AllowASNs, m.DenyASNs)
+	}
+
+	reader := m.db()
+	var result geoResult
+	var cacheKey string
+	if m.cache != nil {
+		cacheKey = addr.String()
+		if cached, ok := m.cache.get(cacheKey, reader); ok {
+			result = cached
+			if m.AddHeaders {
+				setGeoHeaders(r, result.country, result.subdivision, result.city, result.asn)
+			}
+			return result.allowed
+		}
+	}
+
+	result, err = m.lookup(r, addr, reader)
 	if err != nil {
+		return false
+	}
+
+	if m.cache != nil {
+		m.cache.set(cacheKey, reader, result)
+	}
+
+	if m.AddHeaders {
+		setGeoHeaders(r, result.country, result.subdivision, result.city, result.asn)
+	}
+
+	return result.allowed
+}
+
+// geoResult is the outcome of a database lookup: the values to surface via
+// add_headers, and whether the configured dimensions allow the request.
+// It is what gets cached, keyed by client IP, unless cache_size is 0.
+type geoResult struct {
+	country     string
+	subdivision string
+	city        string
+	asn         string
+	allowed     bool
+}
+
+// lookup performs the actual database lookups and dimension checks for
+// addr. It is the cache-miss path: Match consults the cache before calling
+// it, and stores its result afterwards.
+func (m *MaxmindGeolocation) lookup(r *http.Request, addr net.IP, reader *maxminddb.Reader) (geoResult, error) {
+	var record geoRecord
+	if err := reader.Lookup(addr, &record); err != nil {
 		if m.logger != nil {
 			m.logger.Warn("cannot lookup IP address", zap.String("address", r.RemoteAddr), zap.Error(err))
 		}
-		return false
+		return geoResult{}, err
+	}
+
+	result := geoResult{country: record.Country.IsoCode}
+	if len(record.Subdivisions) > 0 {
+		result.subdivision = record.Country.IsoCode + "-" + record.Subdivisions[0].IsoCode
+	}
+	if record.City.GeoNameID != 0 {
+		result.city = strconv.FormatUint(uint64(record.City.GeoNameID), 10)
 	}
 
 	if m.logger != nil {
 		m.logger.Debug(
-			"Detected ip2location data",
+			"Detected geolocation data",
 			zap.String("ip", r.RemoteAddr),
-			zap.String("country", record.Country_short),
+			zap.String("country", result.country),
+			zap.String("subdivision", result.subdivision),
+			zap.String("city", result.city),
 		)
 	}
 
-	if !m.checkAllowed(record.Country_short, m.AllowCountries, m.DenyCountries) {
+	needASN := len(m.AllowASNs) > 0 || len(m.DenyASNs) > 0 || (m.AddHeaders && m.asnDbInst != nil)
+	if needASN {
+		var asn asnRecord
+		if err := m.asnDbInst.Lookup(addr, &asn); err != nil {
+			if m.logger != nil {
+				m.logger.Warn("cannot lookup IP address in ASN database", zap.String("address", r.RemoteAddr), zap.Error(err))
+			}
+			if len(m.AllowASNs) > 0 || len(m.DenyASNs) > 0 {
+				return geoResult{}, err
+			}
+		} else {
+			result.asn = strconv.FormatUint(uint64(asn.AutonomousSystemNumber), 10)
+		}
+	}
+
+	result.allowed = true
+	if !m.countryAllowed(record) {
 		if m.logger != nil {
-			m.logger.Debug("Country not allowed", zap.String("country", record.Country_short))
+			m.logger.Debug(
+				"Country not allowed",
+				zap.String("country", result.country),
+				zap.String("represented_country", record.RepresentedCountry.IsoCode),
+			)
 		}
-		return false
+		result.allowed = false
+	} else if !m.checkAllowed(result.subdivision, m.AllowSubdivisions, m.DenySubdivisions) {
+		if m.logger != nil {
+			m.logger.Debug("Subdivision not allowed", zap.String("subdivision", result.subdivision))
+		}
+		result.allowed = false
+	} else if !m.checkAllowed(result.city, m.AllowCities, m.DenyCities) {
+		if m.logger != nil {
+			m.logger.Debug("City not allowed", zap.String("city", result.city))
+		}
+		result.allowed = false
+	} else if (len(m.AllowASNs) > 0 || len(m.DenyASNs) > 0) && !m.checkAllowed(result.asn, m.AllowASNs, m.DenyASNs) {
+		if m.logger != nil {
+			m.logger.Debug("ASN not allowed", zap.String("asn", result.asn))
+		}
+		result.allowed = false
 	}
 
-	return true
+	return result, nil
 }
@@ -0,0 +1,181 @@
+package caddy_maxmind_geolocation
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newMatcherWithTrustedProxies(t *testing.T, proxies []string, headers []string) *MaxmindGeolocation {
+	t.Helper()
+	m := &MaxmindGeolocation{
+		TrustedProxies:  proxies,
+		ClientIPHeaders: headers,
+	}
+	for _, cidr := range m.TrustedProxies {
+		ipNet, err := parseIPOrCIDR(cidr)
+		if err != nil {
+			t.Fatalf("invalid trusted proxy %q: %v", cidr, err)
+		}
+		m.trustedProxyNets = append(m.trustedProxyNets, ipNet)
+	}
+	if len(m.ClientIPHeaders) == 0 {
+		m.ClientIPHeaders = defaultClientIPHeaders
+	}
+	return m
+}
+
+func TestClientIPUntrustedRemote(t *testing.T) {
+	m := newMatcherWithTrustedProxies(t, nil, nil)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "203.0.113.5:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.9")
+
+	ip, err := m.clientIP(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !ip.Equal(net.ParseIP("203.0.113.5")) {
+		t.Fatalf("expected spoofed header to be ignored, got %s", ip)
+	}
+}
+
+func TestClientIPMultiHopForwardedFor(t *testing.T) {
+	m := newMatcherWithTrustedProxies(t, []string{"10.0.0.0/8", "192.0.2.1/32"}, nil)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "192.0.2.1:443"
+	// client, trusted proxy 1, trusted proxy 2 (closest hop last)
+	r.Header.Set("X-Forwarded-For", "203.0.113.5, 10.0.0.1, 10.0.0.2")
+
+	ip, err := m.clientIP(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !ip.Equal(net.ParseIP("203.0.113.5")) {
+		t.Fatalf("expected 203.0.113.5, got %s", ip)
+	}
+}
+
+func TestClientIPIPv6Bracketed(t *testing.T) {
+	m := newMatcherWithTrustedProxies(t, []string{"10.0.0.0/8"}, nil)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.1:443"
+	r.Header.Set("X-Forwarded-For", "[2001:db8::1]:1234")
+
+	ip, err := m.clientIP(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !ip.Equal(net.ParseIP("2001:db8::1")) {
+		t.Fatalf("expected 2001:db8::1, got %s", ip)
+	}
+}
+
+func TestClientIPRealIPHeader(t *testing.T) {
+	m := newMatcherWithTrustedProxies(t, []string{"10.0.0.0/8"}, []string{"X-Real-IP"})
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.1:443"
+	r.Header.Set("X-Real-IP", "203.0.113.9")
+
+	ip, err := m.clientIP(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !ip.Equal(net.ParseIP("203.0.113.9")) {
+		t.Fatalf("expected 203.0.113.9, got %s", ip)
+	}
+}
+
+func newMatcherWithIPLists(t *testing.T, allow, deny []string) *MaxmindGeolocation {
+	t.Helper()
+	m := &MaxmindGeolocation{AllowIPs: allow, DenyIPs: deny}
+	for _, cidr := range allow {
+		ipNet, err := parseIPOrCIDR(cidr)
+		if err != nil {
+			t.Fatalf("invalid allow_ips entry %q: %v", cidr, err)
+		}
+		m.allowIPNets = append(m.allowIPNets, ipNet)
+	}
+	for _, cidr := range deny {
+		ipNet, err := parseIPOrCIDR(cidr)
+		if err != nil {
+			t.Fatalf("invalid deny_ips entry %q: %v", cidr, err)
+		}
+		m.denyIPNets = append(m.denyIPNets, ipNet)
+	}
+	return m
+}
+
+func TestMatchDenyIPsTakesPrecedence(t *testing.T) {
+	m := newMatcherWithIPLists(t, []string{"203.0.113.0/24"}, []string{"203.0.113.5/32"})
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "203.0.113.5:1234"
+
+	if m.Match(r) {
+		t.Fatal("expected deny_ips to take precedence over allow_ips")
+	}
+}
+
+func TestMatchAllowIPsBypassesLookup(t *testing.T) {
+	m := newMatcherWithIPLists(t, []string{"203.0.113.0/24"}, nil)
+	// AllowCountries is set so that, without the allow_ips short-circuit,
+	// Match would try (and fail) to do a database lookup.
+	m.AllowCountries = []string{"US"}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "203.0.113.5:1234"
+
+	if !m.Match(r) {
+		t.Fatal("expected allow_ips to bypass the database lookup and allow the request")
+	}
+}
+
+func TestMatchIPv6CIDR(t *testing.T) {
+	m := newMatcherWithIPLists(t, []string{"2001:db8::/32"}, nil)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "[2001:db8::1]:443"
+
+	if !m.Match(r) {
+		t.Fatal("expected IPv6 address to match the allow_ips CIDR range")
+	}
+}
+
+func TestMatchAddHeadersPrivateIP(t *testing.T) {
+	m := &MaxmindGeolocation{AddHeaders: true}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "192.168.1.5:1234"
+
+	if !m.Match(r) {
+		t.Fatalf("expected private IP to be allowed when no dimensions are configured")
+	}
+	if got := r.Header.Get("X-IPCountry"); got != "UNK" {
+		t.Fatalf("expected X-IPCountry to be UNK, got %q", got)
+	}
+	if got := r.Header.Get("X-IPASN"); got != "UNK" {
+		t.Fatalf("expected X-IPASN to be UNK, got %q", got)
+	}
+}
+
+func TestClientIPAllTrustedFallsBackToRemote(t *testing.T) {
+	m := newMatcherWithTrustedProxies(t, []string{"10.0.0.0/8"}, nil)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.1:443"
+	r.Header.Set("X-Forwarded-For", "10.0.0.2, 10.0.0.3")
+
+	ip, err := m.clientIP(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !ip.Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("expected fallback to remote addr 10.0.0.1, got %s", ip)
+	}
+}
@@ -0,0 +1,89 @@
+package caddy_maxmind_geolocation
+
+import "testing"
+
+func TestCountryAllowedRepresentedCountryModes(t *testing.T) {
+	tests := []struct {
+		name               string
+		mode               string
+		country            string
+		representedCountry string
+		allow              []string
+		want               bool
+	}{
+		{
+			name:    "ignore mode, no represented country",
+			mode:    RepresentedCountryIgnore,
+			country: "DE",
+			allow:   []string{"DE"},
+			want:    true,
+		},
+		{
+			name:               "ignore mode ignores a mismatched represented country",
+			mode:               RepresentedCountryIgnore,
+			country:            "DE",
+			representedCountry: "US",
+			allow:              []string{"DE"},
+			want:               true,
+		},
+		{
+			name:    "require_match, no represented country, registered allowed",
+			mode:    RepresentedCountryRequireMatch,
+			country: "DE",
+			allow:   []string{"DE"},
+			want:    true,
+		},
+		{
+			name:               "require_match, matching represented country",
+			mode:               RepresentedCountryRequireMatch,
+			country:            "DE",
+			representedCountry: "DE",
+			allow:              []string{"DE"},
+			want:               true,
+		},
+		{
+			name:               "require_match, mismatched represented country is denied",
+			mode:               RepresentedCountryRequireMatch,
+			country:            "DE",
+			representedCountry: "US",
+			allow:              []string{"DE"},
+			want:               false,
+		},
+		{
+			name:    "use_represented, no represented country falls back to registered",
+			mode:    RepresentedCountryUseRepresented,
+			country: "DE",
+			allow:   []string{"DE"},
+			want:    true,
+		},
+		{
+			name:               "use_represented, mismatched represented country is used instead",
+			mode:               RepresentedCountryUseRepresented,
+			country:            "DE",
+			representedCountry: "US",
+			allow:              []string{"US"},
+			want:               true,
+		},
+		{
+			name:               "use_represented, registered country is ignored when represented country present",
+			mode:               RepresentedCountryUseRepresented,
+			country:            "DE",
+			representedCountry: "US",
+			allow:              []string{"DE"},
+			want:               false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &MaxmindGeolocation{RepresentedCountryMode: tt.mode, AllowCountries: tt.allow}
+			var record geoRecord
+			record.Country.IsoCode = tt.country
+			record.RepresentedCountry.IsoCode = tt.representedCountry
+
+			if got := m.countryAllowed(record); got != tt.want {
+				t.Fatalf("countryAllowed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}